@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// authRule grants the listed ops on any topic matching one of the path
+// globs in Topics (matched with path.Match, e.g. "/hmsg/team-a/*").
+type authRule struct {
+	Topics []string `json:"topics"`
+	Ops    []string `json:"ops"`
+}
+
+// authRules maps a bearer token to the rules it's granted. The zero value
+// (no -auth flag) keeps the anonymous ruleset, which allows everything, for
+// backward compatibility.
+var authRules = map[string][]authRule{
+	"": {{Topics: []string{"*"}, Ops: []string{"sub", "pub", "put", "del"}}},
+}
+
+func loadAuth(authPath string) error {
+	content, err := os.ReadFile(authPath)
+	if err != nil {
+		return err
+	}
+
+	var rules map[string][]authRule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return err
+	}
+
+	authRules = rules
+	return nil
+}
+
+func authToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if tok, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return tok
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+func authOp(method string) string {
+	switch method {
+	case http.MethodGet:
+		return "sub"
+	case http.MethodPost:
+		return "pub"
+	case http.MethodPut:
+		return "put"
+	case http.MethodDelete:
+		return "del"
+	default:
+		return ""
+	}
+}
+
+// authorize checks whether r is allowed by authRules, returning the HTTP
+// status to use and whether the request may proceed.
+func authorize(r *http.Request) (int, bool) {
+	rules, ok := authRules[authToken(r)]
+	if !ok {
+		return http.StatusUnauthorized, false
+	}
+
+	op := authOp(r.Method)
+	for _, rule := range rules {
+		if !containsOp(rule.Ops, op) {
+			continue
+		}
+		for _, glob := range rule.Topics {
+			if matchTopic(glob, r.URL.Path) {
+				return http.StatusOK, true
+			}
+		}
+	}
+	return http.StatusForbidden, false
+}
+
+// matchTopic matches a topic path against a glob. "*" is treated as a
+// catch-all spanning any number of path segments; anything else is matched
+// with path.Match, so e.g. "/hmsg/team-a/*" matches one segment under
+// team-a.
+func matchTopic(glob, topicPath string) bool {
+	if glob == "*" {
+		return true
+	}
+	matched, _ := path.Match(glob, topicPath)
+	return matched
+}
+
+func containsOp(ops []string, op string) bool {
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
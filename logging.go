@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var logger = slog.Default()
+
+// setupLogger replaces logger with a handler whose level tracks verbose, so
+// logger.Debug calls (e.g. "clearing topic", "lost a connection") only print
+// under -v. slog.Default()'s handler is fixed at Info level, which would
+// otherwise drop them unconditionally.
+func setupLogger() {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+}
+
+// statusWriter records the status code written by the wrapped handler so
+// withLogging can include it in the access log line. It forwards Flush and
+// Hijack so get's http.Flusher assertion and getWS's http.Hijacker
+// assertion (made by websocket.Accept) both keep working.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not implement http.Hijacker")
+	}
+	return h.Hijack()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withLogging wraps next with an access log line emitted when -v is set,
+// reporting method, path, status, remote addr and duration.
+func withLogging(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next(sw, r)
+
+		if verbose {
+			logger.Info("request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", sw.status,
+				"remote", r.RemoteAddr,
+				"duration", time.Since(start),
+			)
+		}
+	}
+}
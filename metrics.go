@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	messagesPosted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "via_messages_posted_total",
+		Help: "Total number of messages posted, by topic.",
+	}, []string{"topic"})
+
+	activeSubscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "via_active_subscribers",
+		Help: "Current number of subscribers, by topic.",
+	}, []string{"topic"})
+
+	historySize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "via_history_size",
+		Help: "Current number of messages retained in history, by topic.",
+	}, []string{"topic"})
+
+	subscribersDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "via_subscribers_dropped_total",
+		Help: "Total number of subscribers dropped for being too slow, by topic.",
+	}, []string{"topic"})
+
+	connectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "via_connection_duration_seconds",
+		Help:    "Subscriber connection lifetime in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		messagesPosted,
+		activeSubscribers,
+		historySize,
+		subscribersDropped,
+		connectionDuration,
+	)
+}
+
+// deleteTopicMetrics removes key's label series from every topic-labeled
+// metric. Called when a topic is torn down (emptied of subscribers, or
+// shut down) so ephemeral topics don't accumulate unbounded label
+// cardinality in the registry.
+func deleteTopicMetrics(key string) {
+	messagesPosted.DeleteLabelValues(key)
+	activeSubscribers.DeleteLabelValues(key)
+	historySize.DeleteLabelValues(key)
+	subscribersDropped.DeleteLabelValues(key)
+	connectionDuration.DeleteLabelValues(key)
+}
+
+var metricsHandler = promhttp.Handler()
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsHandler.ServeHTTP(w, r)
+}
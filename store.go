@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// storeKind selects the HistoryStore implementation used by newHistoryStore:
+// "json" (the original per-topic file) or "bolt" (this package's embedded
+// key/value backend). A SQLite backend was considered but not implemented;
+// bolt alone satisfies the range-scan-replay and bounded-retention goals
+// without adding a cgo dependency, so -store only ever accepts these two.
+var storeKind = "json"
+
+// maxHistoryAge bounds retention by age in addition to maxHistorySize; zero
+// means no age-based pruning.
+var maxHistoryAge time.Duration
+
+// boltDB is the single shared database used by all bolt-backed topics, each
+// of which gets its own bucket. It is opened once in main when -store=bolt.
+var boltDB *bbolt.DB
+
+// HistoryStore persists the history of a single topic. The JSON file
+// implementation keeps the existing on-disk format; the bolt implementation
+// appends individual records so a post doesn't require rewriting the whole
+// history.
+type HistoryStore interface {
+	// Restore loads messages with Id > afterId, in ascending Id order. It is
+	// used both to rebuild history at startup (afterId 0) and to serve
+	// range-scan replay.
+	Restore(afterId int) ([]Msg, error)
+	// Append persists a single new message and prunes entries beyond
+	// maxHistorySize or older than maxHistoryAge (zero means unbounded).
+	Append(msg Msg, maxHistorySize int, maxHistoryAge time.Duration) error
+	// Replace overwrites the full history, used when put rewrites the log.
+	Replace(history []Msg) error
+	// Delete removes all persisted history for the topic.
+	Delete() error
+}
+
+func newHistoryStore(key string) HistoryStore {
+	filename := historyFilename(key)
+	switch storeKind {
+	case "bolt":
+		return &boltHistoryStore{db: boltDB, bucket: []byte(filename)}
+	default:
+		return &jsonHistoryStore{path: path.Join(dir, filename)}
+	}
+}
+
+func pruneHistory(history []Msg, maxHistorySize int, maxHistoryAge time.Duration) []Msg {
+	for len(history) > maxHistorySize {
+		history = history[1:]
+	}
+
+	if maxHistoryAge > 0 {
+		cutoff := time.Now().Add(-maxHistoryAge)
+		for len(history) > 0 && history[0].Time.Before(cutoff) {
+			history = history[1:]
+		}
+	}
+
+	return history
+}
+
+type jsonHistoryStore struct {
+	path string
+}
+
+func (s *jsonHistoryStore) load() ([]Msg, error) {
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var history []Msg
+	if err := json.Unmarshal(content, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (s *jsonHistoryStore) Restore(afterId int) ([]Msg, error) {
+	history, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Msg, 0, len(history))
+	for _, msg := range history {
+		if msg.Id > afterId {
+			result = append(result, msg)
+		}
+	}
+	return result, nil
+}
+
+func (s *jsonHistoryStore) Append(msg Msg, maxHistorySize int, maxHistoryAge time.Duration) error {
+	history, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	history = append(history, msg)
+	history = pruneHistory(history, maxHistorySize, maxHistoryAge)
+	return s.Replace(history)
+}
+
+func (s *jsonHistoryStore) Replace(history []Msg) error {
+	content, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, content, 0644)
+}
+
+func (s *jsonHistoryStore) Delete() error {
+	err := os.Remove(s.path)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type boltHistoryStore struct {
+	db     *bbolt.DB
+	bucket []byte
+}
+
+func idKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func (s *boltHistoryStore) Restore(afterId int) ([]Msg, error) {
+	var history []Msg
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek(idKey(afterId + 1)); k != nil; k, v = c.Next() {
+			var msg Msg
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			history = append(history, msg)
+		}
+		return nil
+	})
+	return history, err
+}
+
+func (s *boltHistoryStore) Append(msg Msg, maxHistorySize int, maxHistoryAge time.Duration) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+
+		value, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(idKey(msg.Id), value); err != nil {
+			return err
+		}
+
+		var cutoff time.Time
+		if maxHistoryAge > 0 {
+			cutoff = time.Now().Add(-maxHistoryAge)
+		}
+
+		for bucket.Stats().KeyN > maxHistorySize {
+			k, v := bucket.Cursor().First()
+			if k == nil {
+				break
+			}
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			_ = v
+		}
+
+		if !cutoff.IsZero() {
+			// Collect expired keys during a read-only cursor walk first;
+			// mutating the bucket via Delete while a cursor is mid-iteration
+			// is undefined behavior in bbolt. Keys must be copied since
+			// cursor-returned slices are only valid until the next mutation.
+			var expired [][]byte
+			c := bucket.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var m Msg
+				if err := json.Unmarshal(v, &m); err != nil {
+					return err
+				}
+				if !m.Time.Before(cutoff) {
+					break
+				}
+				expired = append(expired, append([]byte(nil), k...))
+			}
+
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *boltHistoryStore) Replace(history []Msg) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(s.bucket); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+
+		bucket, err := tx.CreateBucket(s.bucket)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range history {
+			value, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(idKey(msg.Id), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltHistoryStore) Delete() error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket(s.bucket)
+		if err == bbolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
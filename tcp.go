@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// serveTCP accepts connections on ln and speaks a line-oriented
+// netcat-friendly protocol: a line of the form "topic:payload" publishes to
+// /msg/<topic>, and a bare "topic" line subscribes to /msg/<topic>, after
+// which subsequent messages are streamed back as "id\tdata\n" lines. It
+// returns once ln is closed, which main does as part of shutdown so no new
+// topics get created via TCP after shutdown has begun.
+func serveTCP(ln net.Listener) {
+	logger.Info("serving tcp", "addr", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error("error accepting tcp connection", "err", err)
+			continue
+		}
+		go handleTCP(conn)
+	}
+}
+
+func handleTCP(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.Contains(line, ":") {
+		publishTCPLine(line)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			publishTCPLine(strings.TrimRight(line, "\r\n"))
+		}
+	}
+
+	subscribeTCP(conn, getTopic("/msg/"+line))
+}
+
+func publishTCPLine(line string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return
+	}
+
+	topic := getTopic("/msg/" + line[:i])
+	ch := make(chan int)
+	topic.postChan <- Post{[]byte(line[i+1:]), ch}
+	for range ch {
+		// /msg/ topics have no history, so the channel closes immediately
+	}
+}
+
+func subscribeTCP(conn net.Conn, topic *Topic) {
+	ch := make(chan SubEvent, subBufferSize)
+	topic.subChan <- Sub{ch, 0}
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			go func() {
+				topic.unsubChan <- ch
+			}()
+			for range ch {
+				// drain channel until unsub closes it
+			}
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if event.Gap {
+				continue
+			}
+			if _, err := fmt.Fprintf(conn, "%d\t%s\n", event.Msg.Id, event.Msg.Data); err != nil {
+				go func() {
+					topic.unsubChan <- ch
+				}()
+				for range ch {
+					// drain channel until unsub closes it
+				}
+				return
+			}
+		}
+	}
+}
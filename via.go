@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,21 +12,32 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"go.etcd.io/bbolt"
 )
 
 type Msg struct {
 	Id   int
 	Data []byte
+	Time time.Time
+}
+
+// SubEvent is what's actually sent down a subscriber's channel: either a
+// message, or a gap marker when the subscriber fell behind and some
+// messages were dropped on its behalf.
+type SubEvent struct {
+	Msg Msg
+	Gap bool
 }
 
 type Sub struct {
-	ch     chan Msg
+	ch     chan SubEvent
 	lastId int
 }
 
@@ -37,55 +47,43 @@ type Post struct {
 }
 
 type Topic struct {
-	channels   map[chan Msg]bool
-	hasHistory bool
-	history    []Msg
-	path       string
-	lastId     int
-	subChan    chan Sub
-	unsubChan  chan chan Msg
-	postChan   chan Post
-	putChan    chan Msg
-	delChan    chan struct{}
+	channels     map[chan SubEvent]bool
+	hasHistory   bool
+	history      []Msg
+	store        HistoryStore
+	lastId       int
+	subChan      chan Sub
+	unsubChan    chan chan SubEvent
+	postChan     chan Post
+	putChan      chan Msg
+	delChan      chan struct{}
+	shutdownChan chan struct{}
 }
 
 var mux = &sync.Mutex{}
 var topics = make(map[string]*Topic)
+var topicWG sync.WaitGroup
 var verbose = false
 var maxHistorySize = 100
 var dir = ""
+var tcpAddr = ""
+var authPath = ""
+var shutdownTimeout = 10 * time.Second
+var subBufferSize = 64
+var slowSubscriberPolicy = "drop"
 
 func hasHistory(key string) bool {
 	return strings.HasPrefix(key, "/hmsg/")
 }
 
-func (topic *Topic) storeHistory() {
-	content, err := json.Marshal(topic.history)
-	if err != nil {
-		log.Println("error storing history:", err)
-		return
-	}
-
-	err = os.WriteFile(topic.path, content, 0644)
-	if err != nil {
-		log.Println("error storing history:", err)
-		return
-	}
+func historyFilename(key string) string {
+	return base64.URLEncoding.EncodeToString([]byte(key))
 }
 
 func (topic *Topic) restoreHistory() {
-	content, err := os.ReadFile(topic.path)
+	history, err := topic.store.Restore(0)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			log.Println("error restoring history:", err)
-		}
-		return
-	}
-
-	var history []Msg
-	err = json.Unmarshal(content, &history)
-	if err != nil {
-		log.Println("error restoring history:", err)
+		logger.Error("error restoring history", "err", err)
 		return
 	}
 
@@ -95,55 +93,117 @@ func (topic *Topic) restoreHistory() {
 	}
 }
 
-func (topic *Topic) deleteHistory() {
-	err := os.Remove(topic.path)
-	if err != nil && !os.IsNotExist(err) {
-		log.Println("error deleting history:", err)
-	}
-}
-
 func (topic *Topic) cleanup(key string) bool {
 	if len(topic.channels) > 0 {
 		return false
 	}
 
 	if verbose {
-		log.Println("clearing topic", key)
+		logger.Debug("clearing topic", "topic", key)
 	}
 	mux.Lock()
 	delete(topics, key)
 	mux.Unlock()
+	deleteTopicMetrics(key)
 	return true
 }
 
+// deliver sends msg to ch, applying slowSubscriberPolicy if the
+// subscriber's buffer is full: "disconnect" drops the subscriber outright,
+// while "drop" (the default) evicts enough of its oldest queued events to
+// make room for a gap marker followed by msg, so the subscriber learns it
+// missed something and can reconnect with Last-Event-ID.
+func (topic *Topic) deliver(key string, ch chan SubEvent, msg Msg) {
+	select {
+	case ch <- SubEvent{Msg: msg}:
+		return
+	default:
+	}
+
+	subscribersDropped.WithLabelValues(key).Inc()
+
+	if slowSubscriberPolicy == "disconnect" {
+		close(ch)
+		delete(topic.channels, ch)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ch:
+		default:
+		}
+	}
+	select {
+	case ch <- SubEvent{Gap: true}:
+	default:
+	}
+	select {
+	case ch <- SubEvent{Msg: msg}:
+	default:
+	}
+}
+
 func (topic *Topic) run(key string) {
+	defer topicWG.Done()
+
 	if topic.hasHistory {
 		topic.restoreHistory()
 	}
 
 	for {
 		select {
+		case <-topic.shutdownChan:
+			if topic.hasHistory {
+				if err := topic.store.Replace(topic.history); err != nil {
+					logger.Error("error storing history", "err", err)
+				}
+			}
+			for ch := range topic.channels {
+				close(ch)
+			}
+			mux.Lock()
+			delete(topics, key)
+			mux.Unlock()
+			deleteTopicMetrics(key)
+			return
 		case sub := <-topic.subChan:
+			// Replay blocks rather than applying slowSubscriberPolicy: a
+			// brand-new subscriber hasn't started reading sub.ch yet, so a
+			// non-blocking send here could silently drop backlog (or hand
+			// out a spurious gap marker) whenever subBufferSize is smaller
+			// than the history it's about to receive. The subscriber has no
+			// competing work to do but read, so blocking just makes it wait
+			// for its own replay instead of losing messages it's entitled to.
 			for _, msg := range topic.history {
 				if msg.Id > sub.lastId {
-					sub.ch <- msg
+					sub.ch <- SubEvent{Msg: msg}
 				}
 			}
 
 			topic.channels[sub.ch] = true
+			activeSubscribers.WithLabelValues(key).Set(float64(len(topic.channels)))
 		case ch := <-topic.unsubChan:
-			close(ch)
-			delete(topic.channels, ch)
+			// ch may already have been removed (and closed) by deliver's
+			// disconnect policy; only close it here if it's still live, to
+			// avoid a close of an already-closed channel.
+			if _, ok := topic.channels[ch]; ok {
+				close(ch)
+				delete(topic.channels, ch)
+				activeSubscribers.WithLabelValues(key).Set(float64(len(topic.channels)))
+			}
 		case post := <-topic.postChan:
 			topic.lastId += 1
-			msg := Msg{topic.lastId, post.data}
+			msg := Msg{Id: topic.lastId, Data: post.data, Time: time.Now()}
+			messagesPosted.WithLabelValues(key).Inc()
 
 			if topic.hasHistory {
 				topic.history = append(topic.history, msg)
-				for len(topic.history) > maxHistorySize {
-					topic.history = topic.history[1:]
+				topic.history = pruneHistory(topic.history, maxHistorySize, maxHistoryAge)
+				if err := topic.store.Append(msg, maxHistorySize, maxHistoryAge); err != nil {
+					logger.Error("error storing history", "err", err)
 				}
-				topic.storeHistory()
+				historySize.WithLabelValues(key).Set(float64(len(topic.history)))
 
 				post.ch <- maxHistorySize - len(topic.history)
 			}
@@ -151,7 +211,7 @@ func (topic *Topic) run(key string) {
 			close(post.ch)
 
 			for ch := range topic.channels {
-				ch <- msg
+				topic.deliver(key, ch, msg)
 			}
 		case msg := <-topic.putChan:
 			if len(topic.history) > 0 && msg.Id < topic.history[0].Id {
@@ -166,7 +226,9 @@ func (topic *Topic) run(key string) {
 				}
 			}
 			topic.history = history
-			topic.storeHistory()
+			if err := topic.store.Replace(topic.history); err != nil {
+				logger.Error("error storing history", "err", err)
+			}
 
 			if msg.Id > topic.lastId {
 				topic.lastId = msg.Id
@@ -174,7 +236,10 @@ func (topic *Topic) run(key string) {
 		case _ = <-topic.delChan:
 			topic.history = make([]Msg, 0)
 			topic.lastId = 0
-			topic.deleteHistory()
+			if err := topic.store.Delete(); err != nil {
+				logger.Error("error deleting history", "err", err)
+			}
+			historySize.WithLabelValues(key).Set(0)
 		}
 
 		if topic.cleanup(key) {
@@ -183,26 +248,39 @@ func (topic *Topic) run(key string) {
 	}
 }
 
+// broadcastShutdown signals every live topic to flush history, close its
+// subscribers and exit, returning how many topics were signaled.
+func broadcastShutdown() int {
+	mux.Lock()
+	defer mux.Unlock()
+
+	for _, topic := range topics {
+		close(topic.shutdownChan)
+	}
+	return len(topics)
+}
+
 func getTopic(key string) *Topic {
 	mux.Lock()
 	defer mux.Unlock()
 	topic, exists := topics[key]
 
 	if !exists {
-		filename := base64.URLEncoding.EncodeToString([]byte(key))
 		topic = &Topic{
-			channels:   make(map[chan Msg]bool, 0),
-			hasHistory: hasHistory(key),
-			history:    make([]Msg, 0),
-			path:       path.Join(dir, filename),
-			lastId:     0,
-			subChan:    make(chan Sub),
-			unsubChan:  make(chan chan Msg),
-			postChan:   make(chan Post),
-			putChan:    make(chan Msg),
-			delChan:    make(chan struct{}),
+			channels:     make(map[chan SubEvent]bool, 0),
+			hasHistory:   hasHistory(key),
+			history:      make([]Msg, 0),
+			store:        newHistoryStore(key),
+			lastId:       0,
+			subChan:      make(chan Sub),
+			unsubChan:    make(chan chan SubEvent),
+			postChan:     make(chan Post),
+			putChan:      make(chan Msg),
+			delChan:      make(chan struct{}),
+			shutdownChan: make(chan struct{}),
 		}
 		topics[key] = topic
+		topicWG.Add(1)
 		go topic.run(key)
 	}
 
@@ -217,9 +295,19 @@ func get(w http.ResponseWriter, r *http.Request) {
 
 	topic := getTopic(r.URL.Path)
 
-	ch := make(chan Msg)
+	ch := make(chan SubEvent, subBufferSize)
 	topic.subChan <- Sub{ch, lastId}
 
+	start := time.Now()
+	// observe is called inline at each return, rather than via defer, so it
+	// always runs before the unsubscribe it precedes reaches topic.run: a
+	// deferred Observe would fire only after the drain loop below returns,
+	// by which point topic.cleanup may already have deleted this topic's
+	// connectionDuration series, silently recreating it forever.
+	observe := func() {
+		connectionDuration.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+	}
+
 	ctx := r.Context()
 
 	ticker := time.NewTicker(15 * time.Second)
@@ -240,7 +328,8 @@ func get(w http.ResponseWriter, r *http.Request) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("lost a connection on", r.URL.Path)
+			logger.Debug("lost a connection", "path", r.URL.Path)
+			observe()
 			go func() {
 				topic.unsubChan <- ch
 			}()
@@ -251,8 +340,16 @@ func get(w http.ResponseWriter, r *http.Request) {
 		case <-ticker.C:
 			fmt.Fprintf(w, ": ping\n\n")
 			flusher.Flush()
-		case msg := <-ch:
-			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.Id, msg.Data)
+		case event, ok := <-ch:
+			if !ok {
+				observe()
+				return
+			}
+			if event.Gap {
+				fmt.Fprintf(w, ": reconnect\n\n")
+			} else {
+				fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.Msg.Id, event.Msg.Data)
+			}
 			flusher.Flush()
 		}
 	}
@@ -261,7 +358,7 @@ func get(w http.ResponseWriter, r *http.Request) {
 func post(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Println("error reading request body:", err)
+		logger.Error("error reading request body", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -294,13 +391,13 @@ func put(w http.ResponseWriter, r *http.Request) {
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Println("error reading request body:", err)
+		logger.Error("error reading request body", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
 	topic := getTopic(r.URL.Path)
-	topic.putChan <- Msg{lastId, body}
+	topic.putChan <- Msg{Id: lastId, Data: body, Time: time.Now()}
 }
 
 func del(w http.ResponseWriter, r *http.Request) {
@@ -313,13 +410,25 @@ func del(w http.ResponseWriter, r *http.Request) {
 	topic.delChan <- struct{}{}
 }
 
+func isWebSocketRequest(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	return r.URL.Query().Get("transport") == "ws"
+}
+
 func handler(w http.ResponseWriter, r *http.Request) {
-	if verbose {
-		log.Println(r.Method, r.URL)
+	if status, ok := authorize(r); !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
 	}
 
 	if r.Method == http.MethodGet {
-		get(w, r)
+		if isWebSocketRequest(r) {
+			getWS(w, r)
+		} else {
+			get(w, r)
+		}
 	} else if r.Method == http.MethodPost {
 		post(w, r)
 	} else if r.Method == http.MethodPut {
@@ -333,21 +442,69 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "via [-v] [-d storage_dir] [port]\n")
+		fmt.Fprintf(os.Stderr, "via [-v] [-d storage_dir] [-store json|bolt] [-max-age duration] [-tcp addr] [-auth users.json] [-sub-buffer n] [-slow-subscriber-policy drop|disconnect] [port]\n")
+		fmt.Fprintf(os.Stderr, "-auth has no effect on -tcp: the raw TCP listener is unauthenticated and the two flags cannot be combined.\n")
 		flag.PrintDefaults()
 	}
 
 	flag.BoolVar(&verbose, "v", false, "enable verbose logs")
 	flag.StringVar(&dir, "d", ".", "directory for storage")
+	flag.StringVar(&storeKind, "store", "json", "history storage backend: json or bolt")
+	flag.DurationVar(&maxHistoryAge, "max-age", 0, "max age of history entries, 0 for unbounded")
+	flag.StringVar(&tcpAddr, "tcp", "", "address for a raw netcat-style TCP listener")
+	flag.StringVar(&authPath, "auth", "", "path to a JSON file mapping bearer tokens to topic/op rules (not enforced on -tcp; the two cannot be combined)")
+	flag.IntVar(&subBufferSize, "sub-buffer", 64, "per-subscriber buffered channel depth")
+	flag.StringVar(&slowSubscriberPolicy, "slow-subscriber-policy", "drop", "how to handle a subscriber whose buffer is full: drop or disconnect")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "max time to wait for topics to drain on shutdown")
 	flag.Parse()
 
+	setupLogger()
+
+	if authPath != "" {
+		if err := loadAuth(authPath); err != nil {
+			log.Fatal("error loading auth config:", err)
+		}
+	}
+
+	if slowSubscriberPolicy != "drop" && slowSubscriberPolicy != "disconnect" {
+		log.Fatalf("unknown -slow-subscriber-policy %q, expected drop or disconnect", slowSubscriberPolicy)
+	}
+
+	if authPath != "" && tcpAddr != "" {
+		log.Fatal("-auth and -tcp cannot be combined: the raw TCP listener has no concept of a bearer token, so it would bypass every ACL -auth enforces over HTTP/WS")
+	}
+
+	switch storeKind {
+	case "json":
+	case "bolt":
+		db, err := bbolt.Open(filepath.Join(dir, "via.bolt"), 0600, nil)
+		if err != nil {
+			log.Fatal("error opening bolt store:", err)
+		}
+		defer db.Close()
+		boltDB = db
+	default:
+		log.Fatalf("unknown -store %q, expected json or bolt", storeKind)
+	}
+
 	addr := "localhost:8001"
 	if len(flag.Args()) > 0 {
 		addr = fmt.Sprintf("localhost:%s", flag.Args()[0])
 	}
 
-	http.HandleFunc("/msg/", handler)
-	http.HandleFunc("/hmsg/", handler)
+	http.HandleFunc("/msg/", withLogging(handler))
+	http.HandleFunc("/hmsg/", withLogging(handler))
+	http.HandleFunc("/metrics", withLogging(serveMetrics))
+
+	var tcpListener net.Listener
+	if tcpAddr != "" {
+		ln, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tcpListener = ln
+		go serveTCP(ln)
+	}
 
 	ctx, unregisterSignals := signal.NotifyContext(
 		context.Background(), os.Interrupt, syscall.SIGTERM,
@@ -356,7 +513,7 @@ func main() {
 	server := &http.Server{Addr: addr, BaseContext: ctxFactory}
 
 	go func() {
-		log.Printf("Serving on http://%s", addr)
+		logger.Info("serving", "addr", addr)
 		err := server.ListenAndServe()
 		if err != http.ErrServerClosed {
 			log.Fatal(err)
@@ -365,6 +522,32 @@ func main() {
 
 	<-ctx.Done()
 	unregisterSignals()
-	log.Println("Shutting down serverâ€¦")
-	server.Shutdown(context.Background())
+	logger.Info("shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("error shutting down http server", "err", err)
+	}
+
+	if tcpListener != nil {
+		if err := tcpListener.Close(); err != nil {
+			logger.Error("error closing tcp listener", "err", err)
+		}
+	}
+
+	persisted := broadcastShutdown()
+
+	done := make(chan struct{})
+	go func() {
+		topicWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("shutdown complete", "topics_persisted", persisted)
+	case <-time.After(shutdownTimeout):
+		logger.Warn("shutdown timed out waiting for topics to drain", "topics_persisted", persisted)
+	}
 }
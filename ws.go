@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// getWS is the WebSocket counterpart to get: it subscribes to the same
+// topic fan-out and replays history, but over a bidirectional connection
+// instead of an EventSource stream.
+func getWS(w http.ResponseWriter, r *http.Request) {
+	lastId, err := strconv.Atoi(r.URL.Query().Get("Last-Event-ID"))
+	if err != nil {
+		lastId = 0
+	}
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		logger.Error("error accepting websocket", "err", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	topic := getTopic(r.URL.Path)
+
+	ch := make(chan SubEvent, subBufferSize)
+	topic.subChan <- Sub{ch, lastId}
+
+	start := time.Now()
+	// observe is called inline at each return, rather than via defer, so it
+	// always runs before the unsubscribe it precedes reaches topic.run: a
+	// deferred Observe would fire only after the drain loop below returns,
+	// by which point topic.cleanup may already have deleted this topic's
+	// connectionDuration series, silently recreating it forever.
+	observe := func() {
+		connectionDuration.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+	}
+
+	ctx := r.Context()
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	go wsReadLoop(ctx, conn, topic)
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug("lost a connection", "path", r.URL.Path)
+			observe()
+			unsubscribeWS(topic, ch)
+			conn.Close(websocket.StatusNormalClosure, "")
+			return
+		case <-ticker.C:
+			if err := conn.Ping(ctx); err != nil {
+				observe()
+				unsubscribeWS(topic, ch)
+				return
+			}
+		case event, ok := <-ch:
+			if !ok {
+				observe()
+				return
+			}
+
+			var data string
+			if event.Gap {
+				data = ": reconnect\n\n"
+			} else {
+				data = fmt.Sprintf("id: %d\ndata: %s\n\n", event.Msg.Id, event.Msg.Data)
+			}
+			if err := conn.Write(ctx, websocket.MessageText, []byte(data)); err != nil {
+				observe()
+				unsubscribeWS(topic, ch)
+				return
+			}
+		}
+	}
+}
+
+// unsubscribeWS mirrors the ctx.Done unsubscribe sequence so error returns
+// from Ping/Write also release the subscriber instead of leaking it in
+// topic.channels forever.
+func unsubscribeWS(topic *Topic, ch chan SubEvent) {
+	go func() {
+		topic.unsubChan <- ch
+	}()
+	for range ch {
+		// drain channel until unsub closes it
+	}
+}
+
+// wsReadLoop routes messages published by the client through postChan, the
+// same channel post uses for HTTP publishers.
+func wsReadLoop(ctx context.Context, conn *websocket.Conn, topic *Topic) {
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+
+		ch := make(chan int)
+		topic.postChan <- Post{data, ch}
+		for range ch {
+			// discard the historyRemaining count; ws publishers don't read it
+		}
+	}
+}